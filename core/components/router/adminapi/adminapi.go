@@ -0,0 +1,176 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+// Package adminapi exposes a small, read-only HTTP surface for operators to
+// introspect a running router: which gateways it has heard from, the duty
+// state it has derived for them, the brokers it knows about, and the
+// routes it currently holds. It deliberately depends on nothing from the
+// router package beyond the Backend interface below, so it stays reusable
+// and testable on its own.
+package adminapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// GatewayInfo summarizes the last stats report a router received for a
+// given gateway.
+type GatewayInfo struct {
+	ID        string    `json:"id"`
+	LastSeen  time.Time `json:"last_seen"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	Altitude  int32     `json:"altitude"`
+}
+
+// DutyState describes the RX1/RX2 duty-cycle state the router last derived
+// for a gateway.
+type DutyState struct {
+	SubBand string `json:"sub_band"`
+	RX1     string `json:"rx1"`
+	RX2     string `json:"rx2"`
+}
+
+// BrokerInfo summarizes one of the router's candidate brokers, including
+// the rolling stats the BrokerScorer ranks it by.
+type BrokerInfo struct {
+	Index          int     `json:"index"`
+	Address        string  `json:"address,omitempty"`
+	LastError      string  `json:"last_error,omitempty"`
+	InFlight       int     `json:"in_flight"`
+	EWMALatencyMS  float64 `json:"ewma_latency_ms"`
+	AcceptRatioRX1 float64 `json:"accept_ratio_rx1"`
+	AcceptRatioRX2 float64 `json:"accept_ratio_rx2"`
+}
+
+// RouteEntry is one entry returned by Storage.Lookup for a given DevAddr.
+type RouteEntry struct {
+	BrokerIndex int `json:"broker_index"`
+}
+
+// Event mirrors router.Event for the wire: an uplink or downlink as it
+// passed through the router.
+type Event struct {
+	Kind      string `json:"kind"`
+	GatewayID string `json:"gateway_id"`
+	DevAddr   string `json:"dev_addr,omitempty"`
+}
+
+// Backend is implemented by the router component. It is the only contract
+// between this package and the router's internals.
+type Backend interface {
+	Gateways() []GatewayInfo
+	GatewayDuty(gatewayID string) ([]DutyState, bool)
+	Brokers() []BrokerInfo
+	Routes(devAddr string) ([]RouteEntry, error)
+	Subscribe() (<-chan Event, func())
+}
+
+// Server is the admin HTTP API. It is opt-in: a router only starts one
+// when constructed with router.WithAdminAPI.
+type Server struct {
+	addr    string
+	token   string
+	backend Backend
+	http    *http.Server
+}
+
+// New creates an admin API server bound to addr, guarded by a bearer token.
+// An empty token disables auth, which is only sensible on a loopback or
+// otherwise trusted listener.
+func New(addr, token string, backend Backend) *Server {
+	s := &Server{addr: addr, token: token, backend: backend}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gateways", s.handleGateways)
+	mux.HandleFunc("/gateways/", s.handleGatewayDuty)
+	mux.HandleFunc("/brokers", s.handleBrokers)
+	mux.HandleFunc("/routes/", s.handleRoutes)
+	mux.Handle("/events", websocket.Handler(s.handleEvents))
+
+	s.http = &http.Server{Addr: addr, Handler: s.authenticated(mux)}
+	return s
+}
+
+// ListenAndServe starts the admin API and blocks until it stops.
+func (s *Server) ListenAndServe() error {
+	return s.http.ListenAndServe()
+}
+
+// authenticated wraps next with bearer-token auth. The websocket handshake
+// carries the token as a query parameter since browsers can't set
+// Authorization headers on websocket upgrades.
+func (s *Server) authenticated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.token == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if got == "" {
+			got = r.URL.Query().Get("token")
+		}
+		if got != s.token {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) handleGateways(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.backend.Gateways())
+}
+
+func (s *Server) handleGatewayDuty(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/gateways/"), "/duty")
+	if id == "" || !strings.HasSuffix(r.URL.Path, "/duty") {
+		http.NotFound(w, r)
+		return
+	}
+	duty, ok := s.backend.GatewayDuty(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, duty)
+}
+
+func (s *Server) handleBrokers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.backend.Brokers())
+}
+
+func (s *Server) handleRoutes(w http.ResponseWriter, r *http.Request) {
+	devAddr := strings.TrimPrefix(r.URL.Path, "/routes/")
+	if devAddr == "" {
+		http.NotFound(w, r)
+		return
+	}
+	entries, err := s.backend.Routes(devAddr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, entries)
+}
+
+func (s *Server) handleEvents(ws *websocket.Conn) {
+	defer ws.Close()
+	events, unsubscribe := s.backend.Subscribe()
+	defer unsubscribe()
+	for ev := range events {
+		if err := websocket.JSON.Send(ws, ev); err != nil {
+			return
+		}
+	}
+}
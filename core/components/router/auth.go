@@ -0,0 +1,85 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/TheThingsNetwork/ttn/utils/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// GatewayIdentity is what a GatewayAuthenticator hands back once it has
+// verified that the peer on the call is who it claims to be.
+type GatewayIdentity struct {
+	GatewayID  []byte
+	CertSerial string
+}
+
+// GatewayAuthenticator verifies that whoever is presenting gatewayID on an
+// incoming call is actually that gateway.
+type GatewayAuthenticator interface {
+	Authenticate(ctx context.Context, gatewayID []byte) (GatewayIdentity, error)
+}
+
+// permissiveAuthenticator accepts every gateway unconditionally. It is the
+// router's default so deployments that haven't configured mTLS keep
+// working exactly as before.
+type permissiveAuthenticator struct{}
+
+func (permissiveAuthenticator) Authenticate(ctx context.Context, gatewayID []byte) (GatewayIdentity, error) {
+	return GatewayIdentity{GatewayID: gatewayID}, nil
+}
+
+// TLSPeerAuthenticator authenticates gateways from the client certificate
+// gRPC attaches to the incoming context, matching its CN/SAN against the
+// GatewayID the caller claims.
+type TLSPeerAuthenticator struct{}
+
+// Authenticate implements GatewayAuthenticator.
+func (TLSPeerAuthenticator) Authenticate(ctx context.Context, gatewayID []byte) (GatewayIdentity, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return GatewayIdentity{}, errors.New(errors.Structural, "Missing peer information on context")
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return GatewayIdentity{}, errors.New(errors.Structural, "Missing client certificate")
+	}
+	cert := tlsInfo.State.PeerCertificates[0]
+
+	claimed := fmt.Sprintf("%X", gatewayID)
+	if !strings.EqualFold(cert.Subject.CommonName, claimed) && !containsFold(cert.DNSNames, claimed) {
+		return GatewayIdentity{}, errors.New(errors.Structural, "Gateway certificate does not match the claimed identifier")
+	}
+
+	return GatewayIdentity{GatewayID: gatewayID, CertSerial: cert.SerialNumber.String()}, nil
+}
+
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// identityKey is the context key the authenticated GatewayIdentity is
+// stored under.
+type identityKey struct{}
+
+func withIdentity(ctx context.Context, id GatewayIdentity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// IdentityFromContext retrieves the GatewayIdentity a GatewayAuthenticator
+// stored on ctx, if any.
+func IdentityFromContext(ctx context.Context) (GatewayIdentity, bool) {
+	id, ok := ctx.Value(identityKey{}).(GatewayIdentity)
+	return id, ok
+}
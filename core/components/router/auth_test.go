@@ -0,0 +1,239 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// issuedCert is a self-signed-CA-issued certificate plus the key behind it,
+// ready to plug into a tls.Config.
+type issuedCert struct {
+	cert *x509.Certificate
+	der  []byte
+	key  *ecdsa.PrivateKey
+}
+
+func (c issuedCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// newTestCA creates a minimal self-signed CA for the gRPC server/client
+// certificates of the TestTLSPeerAuthenticator_* tests.
+func newTestCA(t *testing.T) issuedCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate CA key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse CA certificate: %v", err)
+	}
+	return issuedCert{cert: cert, der: der, key: key}
+}
+
+// newTestLeaf issues a certificate for commonName, signed by ca, usable as
+// either a server or a client certificate.
+func newTestLeaf(t *testing.T, ca issuedCert, commonName string) issuedCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate leaf key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to create leaf certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse leaf certificate: %v", err)
+	}
+	return issuedCert{cert: cert, der: der, key: key}
+}
+
+// authOutcome is what the test server's handler observed when it ran
+// TLSPeerAuthenticator.Authenticate against the incoming call's peer.
+type authOutcome struct {
+	identity GatewayIdentity
+	err      error
+}
+
+// startAuthTestServer spins up a real gRPC server on TLS, whose only
+// handler authenticates every incoming call against claimedGatewayID and
+// reports the outcome on the returned channel. clientAuth controls whether
+// the server requires a verified client certificate or merely requests one,
+// so both "valid/mismatched cert" and "no cert presented" scenarios can be
+// driven through an actual handshake rather than asserted in isolation.
+func startAuthTestServer(t *testing.T, ca issuedCert, server issuedCert, clientAuth tls.ClientAuthType, claimedGatewayID []byte) (addr string, outcomes <-chan authOutcome) {
+	t.Helper()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{server.tlsCertificate()},
+		ClientAuth:   clientAuth,
+		ClientCAs:    pool,
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	results := make(chan authOutcome, 1)
+	srv := grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(tlsConfig)),
+		grpc.UnknownServiceHandler(func(_ interface{}, stream grpc.ServerStream) error {
+			identity, authErr := (TLSPeerAuthenticator{}).Authenticate(stream.Context(), claimedGatewayID)
+			results <- authOutcome{identity: identity, err: authErr}
+			return nil
+		}),
+	)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	return lis.Addr().String(), results
+}
+
+// callAuthTestServer dials addr presenting clientCert (nil for none) and
+// waits for the server-side handler to run, returning once it has.
+func callAuthTestServer(t *testing.T, addr string, ca issuedCert, clientCert *issuedCert) error {
+	t.Helper()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	tlsConfig := &tls.Config{RootCAs: pool, ServerName: "localhost"}
+	if clientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{clientCert.tlsCertificate()}
+	}
+
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)), grpc.WithBlock(), grpc.WithTimeout(5*time.Second))
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, "/test.auth/Check")
+	if err != nil {
+		return fmt.Errorf("open stream: %w", err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		return fmt.Errorf("close send: %w", err)
+	}
+	// No message is ever sent, so RecvMsg just blocks until the server ends
+	// the stream - it's only used here to synchronize with the handler.
+	_ = stream.RecvMsg(new(struct{}))
+	return nil
+}
+
+func TestTLSPeerAuthenticator_MatchingCertificateAccepted(t *testing.T) {
+	ca := newTestCA(t)
+	server := newTestLeaf(t, ca, "localhost")
+	gatewayID := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	client := newTestLeaf(t, ca, fmt.Sprintf("%X", gatewayID))
+
+	addr, outcomes := startAuthTestServer(t, ca, server, tls.RequireAndVerifyClientCert, gatewayID)
+	if err := callAuthTestServer(t, addr, ca, &client); err != nil {
+		t.Fatalf("unexpected transport error: %v", err)
+	}
+
+	select {
+	case got := <-outcomes:
+		if got.err != nil {
+			t.Fatalf("expected a matching certificate to authenticate, got error: %v", got.err)
+		}
+		if string(got.identity.GatewayID) != string(gatewayID) {
+			t.Fatalf("expected identity for gateway %X, got %X", gatewayID, got.identity.GatewayID)
+		}
+		if got.identity.CertSerial != client.cert.SerialNumber.String() {
+			t.Fatalf("expected CertSerial %s, got %s", client.cert.SerialNumber.String(), got.identity.CertSerial)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server handler never ran")
+	}
+}
+
+func TestTLSPeerAuthenticator_MismatchedCertificateRejected(t *testing.T) {
+	ca := newTestCA(t)
+	server := newTestLeaf(t, ca, "localhost")
+	gatewayID := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	other := newTestLeaf(t, ca, "AABBCCDDEEFF0011")
+
+	addr, outcomes := startAuthTestServer(t, ca, server, tls.RequireAndVerifyClientCert, gatewayID)
+	if err := callAuthTestServer(t, addr, ca, &other); err != nil {
+		t.Fatalf("unexpected transport error: %v", err)
+	}
+
+	select {
+	case got := <-outcomes:
+		if got.err == nil {
+			t.Fatal("expected a certificate for a different gateway to be rejected")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server handler never ran")
+	}
+}
+
+func TestTLSPeerAuthenticator_MissingCertificateRejected(t *testing.T) {
+	ca := newTestCA(t)
+	server := newTestLeaf(t, ca, "localhost")
+	gatewayID := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+
+	// RequestClientCert, not Require: the handshake must still succeed with
+	// no client certificate presented so Authenticate itself - not the TLS
+	// layer - is what rejects the call.
+	addr, outcomes := startAuthTestServer(t, ca, server, tls.RequestClientCert, gatewayID)
+	if err := callAuthTestServer(t, addr, ca, nil); err != nil {
+		t.Fatalf("unexpected transport error: %v", err)
+	}
+
+	select {
+	case got := <-outcomes:
+		if got.err == nil {
+			t.Fatal("expected a call with no client certificate to be rejected")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server handler never ran")
+	}
+}
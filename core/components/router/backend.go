@@ -0,0 +1,121 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/TheThingsNetwork/ttn/core/components/router/adminapi"
+	"github.com/TheThingsNetwork/ttn/core/dutycycle"
+)
+
+// The methods below make component satisfy adminapi.Backend. They are
+// read-only views over state the router already maintains (or, for
+// gateways/brokers, lightweight bookkeeping kept purely for introspection)
+// and must never be used to drive routing decisions.
+
+// Gateways implements adminapi.Backend. Location metadata is read straight
+// from Storage.LookupStats, the same accessor HandleData uses to enrich
+// uplinks, rather than a second copy kept just for this endpoint.
+func (r component) Gateways() []adminapi.GatewayInfo {
+	lastSeen := r.state.gatewayLastSeen()
+	out := make([]adminapi.GatewayInfo, 0, len(lastSeen))
+	for idHex, seenAt := range lastSeen {
+		info := adminapi.GatewayInfo{ID: idHex, LastSeen: seenAt}
+		if id, err := hex.DecodeString(idHex); err == nil {
+			if gmeta, err := r.LookupStats(id); err == nil {
+				info.Latitude = float64(gmeta.Latitude)
+				info.Longitude = float64(gmeta.Longitude)
+				info.Altitude = int32(gmeta.Altitude)
+			}
+		}
+		out = append(out, info)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// GatewayDuty implements adminapi.Backend.
+func (r component) GatewayDuty(gatewayID string) ([]adminapi.DutyState, bool) {
+	id, err := hex.DecodeString(gatewayID)
+	if err != nil || len(id) != 8 {
+		return nil, false
+	}
+
+	cycles, err := r.manager.Lookup(id)
+	if err != nil {
+		return nil, false
+	}
+
+	rx2 := fmt.Sprintf("%v", dutycycle.StateFromDuty(cycles[dutycycle.EuropeG3]))
+	out := make([]adminapi.DutyState, 0, len(cycles))
+	for band, duty := range cycles {
+		out = append(out, adminapi.DutyState{
+			SubBand: fmt.Sprintf("%v", band),
+			RX1:     fmt.Sprintf("%v", dutycycle.StateFromDuty(duty)),
+			RX2:     rx2,
+		})
+	}
+	return out, true
+}
+
+// Brokers implements adminapi.Backend.
+func (r component) Brokers() []adminapi.BrokerInfo {
+	snapshots := r.state.brokerSnapshots()
+	out := make([]adminapi.BrokerInfo, 0, len(r.brokers))
+	for i := range r.brokers {
+		snap := snapshots[i]
+		score := r.scorer.snapshot(i)
+		var addr string
+		if i < len(r.brokerAddrs) {
+			addr = r.brokerAddrs[i]
+		}
+		out = append(out, adminapi.BrokerInfo{
+			Index:          i,
+			Address:        addr,
+			LastError:      snap.lastErr,
+			InFlight:       snap.inFlight,
+			EWMALatencyMS:  float64(score.ewmaLatency) / float64(time.Millisecond),
+			AcceptRatioRX1: score.accept(false),
+			AcceptRatioRX2: score.accept(true),
+		})
+	}
+	return out
+}
+
+// Routes implements adminapi.Backend.
+func (r component) Routes(devAddrHex string) ([]adminapi.RouteEntry, error) {
+	raw, err := hex.DecodeString(devAddrHex)
+	if err != nil || len(raw) != 4 {
+		return nil, fmt.Errorf("invalid dev addr %q", devAddrHex)
+	}
+	var devAddr [4]byte
+	copy(devAddr[:], raw)
+
+	entries, err := r.Lookup(devAddr)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]adminapi.RouteEntry, 0, len(entries))
+	for _, e := range entries {
+		out = append(out, adminapi.RouteEntry{BrokerIndex: e.BrokerIndex})
+	}
+	return out, nil
+}
+
+// Subscribe implements adminapi.Backend.
+func (r component) Subscribe() (<-chan adminapi.Event, func()) {
+	events, unsubscribe := r.events.subscribe()
+	out := make(chan adminapi.Event)
+	go func() {
+		defer close(out)
+		for ev := range events {
+			out <- adminapi.Event{Kind: string(ev.Kind), GatewayID: hex.EncodeToString(ev.GatewayID), DevAddr: ev.DevAddr}
+		}
+	}()
+	return out, unsubscribe
+}
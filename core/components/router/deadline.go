@@ -0,0 +1,24 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// defaultBrokerTimeout bounds how long we wait on any single broker call
+// before giving up on it. When the remaining candidates are tried is up to
+// send's hedging (hedgeDelay), not this timeout.
+const defaultBrokerTimeout = 2 * time.Second
+
+// withBrokerDeadline is the single place that turns a broker timeout into a
+// cancelable context. It is a package-level variable rather than a direct
+// call to context.WithTimeout so that tests can swap it out for a fake
+// clock and drive timeouts deterministically instead of sleeping in real
+// time.
+var withBrokerDeadline = func(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, timeout)
+}
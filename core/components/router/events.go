@@ -0,0 +1,87 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package router
+
+import "sync"
+
+// eventKind distinguishes the uplink/downlink events published on the
+// router's internal event bus.
+type eventKind string
+
+const (
+	eventUplink   eventKind = "uplink"
+	eventDownlink eventKind = "downlink"
+)
+
+// Event is a snapshot of an uplink or downlink as it passes through
+// HandleData / handleDataDown, published for anyone observing the router
+// at runtime (the admin API's /events websocket, today).
+type Event struct {
+	Kind      eventKind `json:"kind"`
+	GatewayID []byte    `json:"gateway_id"`
+	DevAddr   string    `json:"dev_addr,omitempty"`
+}
+
+// eventBufferSize bounds the ring buffer below: slow subscribers fall
+// behind and start missing the oldest events rather than blocking the
+// router's hot path.
+const eventBufferSize = 256
+
+// eventBus is a bounded, drop-oldest fan-out of router events. It has no
+// notion of "no subscribers" fast path beyond the buffer itself staying
+// small, so publishing stays cheap even when nobody is listening.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[chan Event]struct{})}
+}
+
+// publish fans ev out to every current subscriber. A subscriber that can't
+// keep up should see the most recent events, not get stuck replaying stale
+// ones, so a full channel has its oldest buffered event popped to make room
+// for ev rather than dropping ev itself.
+func (b *eventBus) publish(ev Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+			continue
+		default:
+		}
+
+		// Full: pop the oldest event and retry. A concurrent subscriber may
+		// have drained it first, in which case the send below just finds
+		// room on its own first try.
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- ev:
+		default:
+			// Subscribers only receive and every send happens here under
+			// b.mu, so there is room by now; this branch just guarantees
+			// publish never blocks the caller.
+		}
+	}
+}
+
+// subscribe registers a new listener and returns its channel together with
+// an unsubscribe function the caller must invoke when done.
+func (b *eventBus) subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subs, ch)
+		b.mu.Unlock()
+		close(ch)
+	}
+}
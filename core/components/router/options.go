@@ -0,0 +1,45 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package router
+
+import "github.com/TheThingsNetwork/ttn/core/components/router/adminapi"
+
+// Option configures optional router behavior on top of the mandatory
+// arguments to New. Existing callers that pass none keep compiling and
+// behaving exactly as before.
+type Option func(*component)
+
+// WithAdminAPI starts a read-only admin HTTP API (see package adminapi) on
+// addr, guarded by token. An empty token disables auth and should only be
+// used on a loopback listener.
+func WithAdminAPI(addr, token string) Option {
+	return func(r *component) {
+		server := adminapi.New(addr, token, r)
+		go func() {
+			if err := server.ListenAndServe(); err != nil {
+				r.ctx.WithError(err).Error("Admin API stopped")
+			}
+		}()
+	}
+}
+
+// WithAuthenticator replaces the router's default, permissive
+// GatewayAuthenticator with auth. Use TLSPeerAuthenticator{} to require a
+// matching client certificate on every HandleStats/HandleData call.
+func WithAuthenticator(auth GatewayAuthenticator) Option {
+	return func(r *component) {
+		r.auth = auth
+	}
+}
+
+// WithBrokerAddresses records the dial address of each of New's brokers, in
+// the same order, so the admin API's /brokers endpoint can surface it
+// alongside the index. It is optional purely because core.BrokerClient
+// carries no address of its own to fall back on; without it, BrokerInfo.Address
+// is left empty.
+func WithBrokerAddresses(addrs []string) Option {
+	return func(r *component) {
+		r.brokerAddrs = addrs
+	}
+}
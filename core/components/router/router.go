@@ -4,28 +4,62 @@
 package router
 
 import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/KtorZ/rpc/core"
+	"github.com/TheThingsNetwork/ttn/core/components/router/telemetry"
 	"github.com/TheThingsNetwork/ttn/core/dutycycle"
 	"github.com/TheThingsNetwork/ttn/utils/errors"
 	"github.com/TheThingsNetwork/ttn/utils/stats"
 	"github.com/apex/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
 	"golang.org/x/net/context"
 )
 
 type component struct {
 	Storage
-	manager dutycycle.DutyManager
-	brokers []core.BrokerClient
-	ctx     log.Interface
+	manager       dutycycle.DutyManager
+	brokers       []core.BrokerClient
+	brokerAddrs   []string
+	ctx           log.Interface
+	brokerTimeout time.Duration
+	events        *eventBus
+	state         *routerState
+	auth          GatewayAuthenticator
+	scorer        *BrokerScorer
 }
 
-// New constructs a new router
-func New(db Storage, dm dutycycle.DutyManager, brokers []core.BrokerClient, ctx log.Interface) core.RouterServer {
-	return component{Storage: db, manager: dm, brokers: brokers, ctx: ctx}
+// New constructs a new router. opts can be used to enable optional
+// behavior (see WithAdminAPI); existing callers that pass none get the
+// same router as before.
+func New(db Storage, dm dutycycle.DutyManager, brokers []core.BrokerClient, ctx log.Interface, opts ...Option) core.RouterServer {
+	r := &component{
+		Storage:       db,
+		manager:       dm,
+		brokers:       brokers,
+		ctx:           ctx,
+		brokerTimeout: defaultBrokerTimeout,
+		events:        newEventBus(),
+		state:         newRouterState(),
+		auth:          permissiveAuthenticator{},
+		scorer:        newBrokerScorer(),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return *r
 }
 
 // HandleStats implements the core.RouterClient interface
 func (r component) HandleStats(ctx context.Context, req *core.StatsReq) (*core.StatsRes, error) {
+	ctx, span := telemetry.Default().Tracer.Start(ctx, "router.HandleStats")
+	defer span.End()
+
 	if req == nil {
 		return nil, errors.New(errors.Structural, "Invalid nil stats request")
 	}
@@ -33,20 +67,35 @@ func (r component) HandleStats(ctx context.Context, req *core.StatsReq) (*core.S
 	if len(req.GatewayID) != 8 {
 		return nil, errors.New(errors.Structural, "Invalid gateway identifier")
 	}
+	span.SetAttributes(telemetry.GatewayID(req.GatewayID))
 
 	if req.Metadata == nil {
 		return nil, errors.New(errors.Structural, "Missing mandatory Metadata")
 	}
 
+	identity, authErr := r.auth.Authenticate(ctx, req.GatewayID)
+	if authErr != nil {
+		stats.MarkMeter("router.auth.failed")
+		r.ctx.WithField("gateway_eui", hex.EncodeToString(req.GatewayID)).WithError(authErr).Warn("Gateway authentication failed")
+		return nil, errors.New(errors.Structural, authErr)
+	}
+	ctx = withIdentity(ctx, identity)
+	r.ctx = r.ctx.WithField("gateway_eui", hex.EncodeToString(identity.GatewayID)).WithField("cert_serial", identity.CertSerial)
+
 	stats.MarkMeter("router.stat.in")
+	r.state.seenGateway(hex.EncodeToString(req.GatewayID), time.Now())
 	return nil, r.UpdateStats(req.GatewayID, *req.Metadata)
 }
 
 // HandleData implements the core.RouterClient interface
 func (r component) HandleData(ctx context.Context, req *core.DataRouterReq) (*core.DataRouterRes, error) {
+	ctx, span := telemetry.Default().Tracer.Start(ctx, "router.HandleData")
+	defer span.End()
+
 	// Get some logs / analytics
 	r.ctx.Debug("Handling uplink packet")
 	stats.MarkMeter("router.uplink.in")
+	telemetry.Instrument().UplinkIn.Add(ctx, 1)
 
 	// Validate coming data
 	_, _, fhdr, _, err := core.ValidateLoRaWANData(req.Payload)
@@ -60,6 +109,23 @@ func (r component) HandleData(ctx context.Context, req *core.DataRouterReq) (*co
 		return nil, errors.New(errors.Structural, "Invalid gatewayID")
 	}
 
+	identity, authErr := r.auth.Authenticate(ctx, req.GatewayID)
+	if authErr != nil {
+		stats.MarkMeter("router.auth.failed")
+		r.ctx.WithField("gateway_eui", hex.EncodeToString(req.GatewayID)).WithError(authErr).Warn("Gateway authentication failed")
+		return nil, errors.New(errors.Structural, authErr)
+	}
+	ctx = withIdentity(ctx, identity)
+	r.ctx = r.ctx.WithField("gateway_eui", hex.EncodeToString(identity.GatewayID)).WithField("cert_serial", identity.CertSerial)
+
+	span.SetAttributes(telemetry.GatewayID(req.GatewayID), attribute.String("dev_addr", fmt.Sprintf("%v", fhdr.DevAddr)))
+	r.events.publish(Event{Kind: eventUplink, GatewayID: req.GatewayID, DevAddr: fmt.Sprintf("%v", fhdr.DevAddr)})
+
+	start := time.Now()
+	defer func() {
+		telemetry.Instrument().UplinkDuration.Record(ctx, time.Since(start).Seconds())
+	}()
+
 	// Lookup for an existing broker
 	entries, err := r.Lookup(fhdr.DevAddr)
 	if err != nil && err.(errors.Failure).Nature != errors.NotFound {
@@ -88,28 +154,38 @@ func (r component) HandleData(ctx context.Context, req *core.DataRouterReq) (*co
 		return nil, errors.New(errors.Structural, "Unhandled uplink signal frequency")
 	}
 
-	rx1, rx2 := uint(dutycycle.StateFromDuty(cycles[sb1])), uint(dutycycle.StateFromDuty(cycles[dutycycle.EuropeG3]))
+	rx1State, rx2State := dutycycle.StateFromDuty(cycles[sb1]), dutycycle.StateFromDuty(cycles[dutycycle.EuropeG3])
+	rx1, rx2 := uint(rx1State), uint(rx2State)
 	req.Metadata.DutyRX1, req.Metadata.DutyRX2 = uint32(rx1), uint32(rx2)
 
+	span.SetAttributes(
+		attribute.Int("frequency", int(req.Metadata.Frequency)),
+		attribute.Int("sub_band", int(sb1)),
+		attribute.Int64("duty_rx1", int64(rx1)),
+		attribute.Int64("duty_rx2", int64(rx2)),
+		attribute.Bool("broadcast", shouldBroadcast),
+	)
+
 	bpacket := &core.DataBrokerReq{Payload: req.Payload, Metadata: req.Metadata}
 
 	// Send packet to broker(s)
 	var response *core.DataBrokerRes
 	if shouldBroadcast {
 		// No Recipient available -> broadcast
-		response, err = r.send(bpacket, r.brokers...)
+		response, err = r.send(ctx, bpacket, rx1State, rx2State, r.allCandidates())
 	} else {
 		// Recipients are available
-		var brokers []core.BrokerClient
+		var candidates []brokerCandidate
 		for _, e := range entries {
-			brokers = append(brokers, r.brokers[e.BrokerIndex])
+			candidates = append(candidates, brokerCandidate{index: e.BrokerIndex, client: r.brokers[e.BrokerIndex]})
 		}
-		response, err = r.send(bpacket, brokers...)
+		response, err = r.send(ctx, bpacket, rx1State, rx2State, candidates)
 		if err != nil && err.(errors.Failure).Nature == errors.NotFound {
 			// Might be a collision with the dev addr, we better broadcast
-			response, err = r.send(bpacket, r.brokers...)
+			response, err = r.send(ctx, bpacket, rx1State, rx2State, r.allCandidates())
 		}
 		stats.MarkMeter("router.uplink.out")
+		telemetry.Instrument().UplinkOut.Add(ctx, 1)
 	}
 
 	if err != nil {
@@ -122,13 +198,18 @@ func (r component) HandleData(ctx context.Context, req *core.DataRouterReq) (*co
 		return nil, err
 	}
 
-	return r.handleDataDown(response, req.GatewayID)
+	return r.handleDataDown(ctx, response, req.GatewayID)
 }
 
-func (r component) handleDataDown(req *core.DataBrokerRes, gatewayID []byte) (*core.DataRouterRes, error) {
+func (r component) handleDataDown(ctx context.Context, req *core.DataBrokerRes, gatewayID []byte) (*core.DataRouterRes, error) {
+	ctx, span := telemetry.Default().Tracer.Start(ctx, "router.handleDataDown")
+	defer span.End()
+	span.SetAttributes(telemetry.GatewayID(gatewayID))
+
 	if req == nil { // No response
 		return nil, nil
 	}
+	r.events.publish(Event{Kind: eventDownlink, GatewayID: gatewayID})
 
 	// Update downlink metadata for the related gateway
 	if req.Metadata == nil {
@@ -147,9 +228,128 @@ func (r component) handleDataDown(req *core.DataBrokerRes, gatewayID []byte) (*c
 	return &core.DataRouterRes{Payload: req.Payload, Metadata: req.Metadata}, nil
 }
 
-func (r component) send(req *core.DataBrokerReq, brokers ...core.BrokerClient) (*core.DataBrokerRes, error) {
+// allCandidates wraps every known broker as a brokerCandidate, preserving
+// its index in r.brokers, for a broadcast send.
+func (r component) allCandidates() []brokerCandidate {
+	out := make([]brokerCandidate, len(r.brokers))
+	for i, b := range r.brokers {
+		out[i] = brokerCandidate{index: i, client: b}
+	}
+	return out
+}
+
+// send tries candidates in scorer-ranked order: it fires the top hedgeTopN
+// at once and, if none of them has answered within hedgeDelay, fans out to
+// the rest. It returns as soon as one broker comes back with a usable
+// response, canceling every other in-flight call.
+func (r component) send(ctx context.Context, req *core.DataBrokerReq, rx1, rx2 dutycycle.State, candidates []brokerCandidate) (*core.DataBrokerRes, error) {
+	ctx, span := telemetry.Default().Tracer.Start(ctx, "router.send")
+	defer span.End()
+	span.SetAttributes(attribute.Int("broker_count", len(candidates)))
+
+	if len(candidates) == 0 {
+		return nil, errors.New(errors.NotFound, "No broker to send the packet to")
+	}
+
+	ordered := reorder(candidates, r.scorer.rank(candidateIndices(candidates), rx1, rx2))
+	rx2Call := rx1 == dutycycle.StateBlocked
 
-	return nil, nil
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		res *core.DataBrokerRes
+		err error
+	}
+	results := make(chan result, len(ordered))
+
+	var wg sync.WaitGroup
+	wg.Add(len(ordered))
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	call := func(c brokerCandidate) {
+		defer wg.Done()
+		spanCtx, bspan := telemetry.Default().Tracer.Start(ctx, "router.send.broker")
+		bspan.SetAttributes(attribute.Int("broker_index", c.index))
+		defer bspan.End()
+		r.state.brokerCallStarted(c.index)
+		bctx, bcancel := withBrokerDeadline(spanCtx, r.brokerTimeout)
+		defer bcancel()
+		bstart := time.Now()
+		res, err := c.client.HandleData(bctx, req)
+		latency := time.Since(bstart)
+		r.state.brokerCallFinished(c.index, err)
+		r.scorer.observe(c.index, latency, err == nil && res != nil, rx2Call)
+		telemetry.Instrument().BrokerDuration.Record(ctx, latency.Seconds(),
+			metric.WithAttributes(attribute.Int("broker_index", c.index)))
+		if err != nil {
+			nature := errors.Operational
+			if f, ok := err.(errors.Failure); ok {
+				nature = f.Nature
+			}
+			bspan.RecordError(err)
+			telemetry.Instrument().BrokerErrors.Add(ctx, 1,
+				metric.WithAttributes(attribute.Int("broker_index", c.index), attribute.String("nature", fmt.Sprintf("%v", nature))))
+		}
+		// End the span before handing the result over, so it is already
+		// recorded by the time send returns on it.
+		bspan.End()
+		select {
+		case results <- result{res, err}:
+		case <-ctx.Done():
+		}
+	}
+
+	hedgeN := hedgeTopN
+	if hedgeN > len(ordered) {
+		hedgeN = len(ordered)
+	}
+	for _, c := range ordered[:hedgeN] {
+		go call(c)
+	}
+	if rest := ordered[hedgeN:]; len(rest) > 0 {
+		go func() {
+			select {
+			case <-time.After(hedgeDelay):
+			case <-ctx.Done():
+			}
+			for _, c := range rest {
+				go func(c brokerCandidate) {
+					select {
+					case <-ctx.Done():
+						wg.Done()
+					default:
+						call(c)
+					}
+				}(c)
+			}
+		}()
+	}
+
+	var notFound, failed int
+	var errs []string
+	for res := range results {
+		if res.err == nil && res.res != nil {
+			return res.res, nil
+		}
+		if res.err == nil {
+			continue
+		}
+		errs = append(errs, res.err.Error())
+		if f, ok := res.err.(errors.Failure); ok && f.Nature == errors.NotFound {
+			notFound++
+		} else {
+			failed++
+		}
+	}
+
+	if notFound == len(candidates) {
+		return nil, errors.New(errors.NotFound, "No broker found a route for this packet")
+	}
+	return nil, errors.New(errors.Operational, fmt.Sprintf("All %d broker(s) failed: %s", failed+notFound, strings.Join(errs, "; ")))
 }
 
 // Register implements the core.Router interface
@@ -0,0 +1,189 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/KtorZ/rpc/core"
+	"github.com/TheThingsNetwork/ttn/core/dutycycle"
+)
+
+const (
+	// scorerEWMAAlpha weights how quickly a broker's rolling stats react to
+	// a new observation; low values smooth out one-off slow/failed calls.
+	scorerEWMAAlpha = 0.2
+	// hedgeTopN is how many of the best-ranked brokers send fires at once
+	// before considering the rest.
+	hedgeTopN = 2
+	// hedgeDelay is how long send waits on the top-ranked brokers before
+	// fanning out to the remaining candidates.
+	hedgeDelay = 50 * time.Millisecond
+	// unobservedLatency is the effective EWMA latency attributed to a broker
+	// with no observations yet. It must lose latency-based comparisons
+	// against any broker with real history, or an untested broker's zero
+	// ewmaLatency would always sort first - the same "don't let untested
+	// brokers beat proven-good ones" fairness accept() already gives the
+	// accept ratio.
+	unobservedLatency = time.Hour
+)
+
+// brokerScore is one broker's rolling call history. Accept ratios are kept
+// separately for calls made while RX1 was available versus blocked, since
+// a broker that reliably schedules RX1 downlinks says little about how it
+// does when the router has to fall back to RX2.
+type brokerScore struct {
+	ewmaLatency time.Duration
+	acceptRX1   float64
+	obsRX1      int
+	acceptRX2   float64
+	obsRX2      int
+}
+
+// accept returns the broker's rolling downlink-accept ratio for the given
+// duty window, defaulting to a neutral 0.5 when there is no history yet so
+// untested brokers get a fair shot against proven-bad ones without being
+// preferred over proven-good ones.
+func (s brokerScore) accept(rx2 bool) float64 {
+	if rx2 {
+		if s.obsRX2 == 0 {
+			return 0.5
+		}
+		return s.acceptRX2
+	}
+	if s.obsRX1 == 0 {
+		return 0.5
+	}
+	return s.acceptRX1
+}
+
+// latency returns the broker's rolling EWMA latency, or unobservedLatency
+// when there's no history yet, so an untested broker can't win a
+// latency-based comparison purely by never having been tried.
+func (s brokerScore) latency() time.Duration {
+	if s.obsRX1+s.obsRX2 == 0 {
+		return unobservedLatency
+	}
+	return s.ewmaLatency
+}
+
+// BrokerScorer ranks candidate brokers by how likely they are to yield a
+// schedulable downlink, based on their rolling latency and accept-ratio
+// history, and drives send's hedging decisions.
+type BrokerScorer struct {
+	mu     sync.Mutex
+	scores map[int]brokerScore
+}
+
+func newBrokerScorer() *BrokerScorer {
+	return &BrokerScorer{scores: make(map[int]brokerScore)}
+}
+
+// observe folds the outcome of one broker call into its rolling stats.
+// rx2 indicates whether the call was made while RX1 was blocked, i.e.
+// whether it exercises the broker's RX2 capability.
+func (s *BrokerScorer) observe(brokerIndex int, latency time.Duration, accepted, rx2 bool) {
+	accept := 0.0
+	if accepted {
+		accept = 1.0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sc := s.scores[brokerIndex]
+	if sc.obsRX1+sc.obsRX2 == 0 {
+		sc.ewmaLatency = latency
+	} else {
+		sc.ewmaLatency = time.Duration(float64(sc.ewmaLatency)*(1-scorerEWMAAlpha) + float64(latency)*scorerEWMAAlpha)
+	}
+	if rx2 {
+		if sc.obsRX2 == 0 {
+			sc.acceptRX2 = accept
+		} else {
+			sc.acceptRX2 = sc.acceptRX2*(1-scorerEWMAAlpha) + accept*scorerEWMAAlpha
+		}
+		sc.obsRX2++
+	} else {
+		if sc.obsRX1 == 0 {
+			sc.acceptRX1 = accept
+		} else {
+			sc.acceptRX1 = sc.acceptRX1*(1-scorerEWMAAlpha) + accept*scorerEWMAAlpha
+		}
+		sc.obsRX1++
+	}
+	s.scores[brokerIndex] = sc
+}
+
+func (s *BrokerScorer) snapshot(brokerIndex int) brokerScore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scores[brokerIndex]
+}
+
+func (s *BrokerScorer) snapshots() map[int]brokerScore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[int]brokerScore, len(s.scores))
+	for i, sc := range s.scores {
+		out[i] = sc
+	}
+	return out
+}
+
+// rank orders candidates best-first: highest relevant accept ratio, ties
+// broken by lower EWMA latency. When rx1 is blocked, ranking is driven by
+// each broker's RX2 history instead of its RX1 one. When both rx1 and rx2
+// are blocked, no broker can schedule a downlink at all right now, so the
+// accept-ratio history is moot and candidates are ordered by EWMA latency
+// alone - the fastest ack still matters even without a downlink window.
+func (s *BrokerScorer) rank(candidates []int, rx1, rx2 dutycycle.State) []int {
+	useRX2 := rx1 == dutycycle.StateBlocked
+	bothBlocked := useRX2 && rx2 == dutycycle.StateBlocked
+	scores := s.snapshots()
+
+	ranked := append([]int(nil), candidates...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := scores[ranked[i]], scores[ranked[j]]
+		if bothBlocked {
+			return a.latency() < b.latency()
+		}
+		sa, sb := a.accept(useRX2), b.accept(useRX2)
+		if sa != sb {
+			return sa > sb
+		}
+		return a.latency() < b.latency()
+	})
+	return ranked
+}
+
+// brokerCandidate pairs a broker client with its index in component.brokers
+// so scoring/hedging and the admin API can refer back to a stable identity
+// regardless of whether send was called with the full broker list (a
+// broadcast) or a filtered subset (a targeted send).
+type brokerCandidate struct {
+	index  int
+	client core.BrokerClient
+}
+
+func candidateIndices(candidates []brokerCandidate) []int {
+	out := make([]int, len(candidates))
+	for i, c := range candidates {
+		out[i] = c.index
+	}
+	return out
+}
+
+func reorder(candidates []brokerCandidate, order []int) []brokerCandidate {
+	byIndex := make(map[int]brokerCandidate, len(candidates))
+	for _, c := range candidates {
+		byIndex[c.index] = c
+	}
+	out := make([]brokerCandidate, len(order))
+	for i, idx := range order {
+		out[i] = byIndex[idx]
+	}
+	return out
+}
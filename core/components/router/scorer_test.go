@@ -0,0 +1,66 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheThingsNetwork/ttn/core/dutycycle"
+)
+
+func TestRank_RX1Blocked_UsesRX2Capability(t *testing.T) {
+	s := newBrokerScorer()
+	// Broker 0: great on RX1, poor on RX2.
+	s.observe(0, time.Millisecond, true, false)
+	s.observe(0, time.Millisecond, true, false)
+	s.observe(0, time.Millisecond, false, true)
+	s.observe(0, time.Millisecond, false, true)
+	// Broker 1: poor on RX1, great on RX2.
+	s.observe(1, time.Millisecond, false, false)
+	s.observe(1, time.Millisecond, false, false)
+	s.observe(1, time.Millisecond, true, true)
+	s.observe(1, time.Millisecond, true, true)
+
+	ranked := s.rank([]int{0, 1}, dutycycle.StateBlocked, dutycycle.State(0))
+	if ranked[0] != 1 {
+		t.Fatalf("expected broker 1 (better RX2 history) to rank first when RX1 is blocked, got order %v", ranked)
+	}
+}
+
+func TestRank_BothBlocked_PrefersLowerLatency(t *testing.T) {
+	s := newBrokerScorer()
+	s.observe(0, 100*time.Millisecond, true, false)
+	s.observe(1, 10*time.Millisecond, false, false)
+
+	ranked := s.rank([]int{0, 1}, dutycycle.StateBlocked, dutycycle.StateBlocked)
+	if ranked[0] != 1 {
+		t.Fatalf("expected the lower-latency broker to rank first when both RX1 and RX2 are blocked, got order %v", ranked)
+	}
+}
+
+func TestRank_BothBlocked_UnobservedBrokerDoesNotBeatProvenLatency(t *testing.T) {
+	s := newBrokerScorer()
+	// Broker 0 has real, good latency history; broker 1 has none at all and
+	// must not win purely because its zero-value ewmaLatency looks faster.
+	s.observe(0, 10*time.Millisecond, true, false)
+
+	ranked := s.rank([]int{0, 1}, dutycycle.StateBlocked, dutycycle.StateBlocked)
+	if ranked[0] != 0 {
+		t.Fatalf("expected the broker with real latency history to rank first over an untested one, got order %v", ranked)
+	}
+}
+
+func TestScorer_ConvergesAfterNObservations(t *testing.T) {
+	s := newBrokerScorer()
+	s.observe(0, time.Millisecond, false, false)
+	for i := 0; i < 50; i++ {
+		s.observe(0, time.Millisecond, true, false)
+	}
+
+	got := s.snapshot(0).accept(false)
+	if got < 0.95 {
+		t.Fatalf("expected accept ratio to converge close to 1 after repeated successes, got %v", got)
+	}
+}
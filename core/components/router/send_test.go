@@ -0,0 +1,239 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/KtorZ/rpc/core"
+	"github.com/TheThingsNetwork/ttn/core/dutycycle"
+	"github.com/TheThingsNetwork/ttn/utils/errors"
+	"github.com/apex/log"
+	"golang.org/x/net/context"
+)
+
+// fakeBroker is a minimal core.BrokerClient used to drive send under test.
+type fakeBroker struct {
+	calls  int32
+	handle func(ctx context.Context, req *core.DataBrokerReq) (*core.DataBrokerRes, error)
+}
+
+func (f *fakeBroker) HandleData(ctx context.Context, req *core.DataBrokerReq) (*core.DataBrokerRes, error) {
+	atomic.AddInt32(&f.calls, 1)
+	return f.handle(ctx, req)
+}
+
+func newTestComponent(timeout time.Duration) component {
+	return component{
+		ctx:           log.Log,
+		brokerTimeout: timeout,
+		events:        newEventBus(),
+		state:         newRouterState(),
+		scorer:        newBrokerScorer(),
+	}
+}
+
+func candidatesOf(brokers ...core.BrokerClient) []brokerCandidate {
+	out := make([]brokerCandidate, len(brokers))
+	for i, b := range brokers {
+		out[i] = brokerCandidate{index: i, client: b}
+	}
+	return out
+}
+
+func TestSend_SingleBrokerSuccess(t *testing.T) {
+	r := newTestComponent(time.Second)
+	want := &core.DataBrokerRes{}
+	broker := &fakeBroker{handle: func(ctx context.Context, req *core.DataBrokerReq) (*core.DataBrokerRes, error) {
+		return want, nil
+	}}
+
+	got, err := r.send(context.Background(), &core.DataBrokerReq{}, dutycycle.State(0), dutycycle.State(0), candidatesOf(broker))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != want {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestSend_FirstSuccessWinsWithSlowPeers(t *testing.T) {
+	r := newTestComponent(time.Second)
+	want := &core.DataBrokerRes{}
+	unblock := make(chan struct{})
+
+	fast := &fakeBroker{handle: func(ctx context.Context, req *core.DataBrokerReq) (*core.DataBrokerRes, error) {
+		return want, nil
+	}}
+	slow := &fakeBroker{handle: func(ctx context.Context, req *core.DataBrokerReq) (*core.DataBrokerRes, error) {
+		select {
+		case <-unblock:
+		case <-ctx.Done():
+		}
+		return &core.DataBrokerRes{}, nil
+	}}
+	defer close(unblock)
+
+	got, err := r.send(context.Background(), &core.DataBrokerReq{}, dutycycle.State(0), dutycycle.State(0), candidatesOf(fast, slow))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != want {
+		t.Fatalf("expected the fast broker's response, got %v", got)
+	}
+}
+
+func TestSend_AllNotFound(t *testing.T) {
+	r := newTestComponent(time.Second)
+	notFound := func(ctx context.Context, req *core.DataBrokerReq) (*core.DataBrokerRes, error) {
+		return nil, errors.New(errors.NotFound, "no route")
+	}
+	brokers := []core.BrokerClient{
+		&fakeBroker{handle: notFound},
+		&fakeBroker{handle: notFound},
+	}
+
+	_, err := r.send(context.Background(), &core.DataBrokerReq{}, dutycycle.State(0), dutycycle.State(0), candidatesOf(brokers...))
+	if err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+	if nature := err.(errors.Failure).Nature; nature != errors.NotFound {
+		t.Fatalf("expected NotFound, got %v", nature)
+	}
+}
+
+func TestSend_MixedErrors(t *testing.T) {
+	r := newTestComponent(time.Second)
+	brokers := []core.BrokerClient{
+		&fakeBroker{handle: func(ctx context.Context, req *core.DataBrokerReq) (*core.DataBrokerRes, error) {
+			return nil, errors.New(errors.NotFound, "no route")
+		}},
+		&fakeBroker{handle: func(ctx context.Context, req *core.DataBrokerReq) (*core.DataBrokerRes, error) {
+			return nil, errors.New(errors.Operational, "broker unavailable")
+		}},
+	}
+
+	_, err := r.send(context.Background(), &core.DataBrokerReq{}, dutycycle.State(0), dutycycle.State(0), candidatesOf(brokers...))
+	if err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+	// Not every broker said NotFound, so the aggregate failure must not be
+	// reported as NotFound - the caller's broadcast-retry logic only kicks
+	// in when there really is no route anywhere.
+	if nature := err.(errors.Failure).Nature; nature != errors.Operational {
+		t.Fatalf("expected Operational, got %v", nature)
+	}
+	// Both brokers' failures must be visible in the aggregate error, not
+	// just whichever one happened to be read off the results channel last.
+	if !strings.Contains(err.Error(), "no route") || !strings.Contains(err.Error(), "broker unavailable") {
+		t.Fatalf("expected the aggregate error to mention every broker's failure, got %q", err.Error())
+	}
+}
+
+func TestSend_ContextCancellationFromCaller(t *testing.T) {
+	r := newTestComponent(time.Second)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	broker := &fakeBroker{handle: func(ctx context.Context, req *core.DataBrokerReq) (*core.DataBrokerRes, error) {
+		defer wg.Done()
+		<-ctx.Done()
+		return nil, errors.New(errors.Operational, ctx.Err())
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := r.send(ctx, &core.DataBrokerReq{}, dutycycle.State(0), dutycycle.State(0), candidatesOf(broker))
+	if err == nil {
+		t.Fatal("expected an error once the caller's context was canceled")
+	}
+	wg.Wait()
+}
+
+// TestSend_DeterministicBrokerTimeout exercises the withBrokerDeadline hook
+// directly: by swapping it out for an already-expired context, a broker
+// deadline can be driven without sleeping on the real clock.
+func TestSend_DeterministicBrokerTimeout(t *testing.T) {
+	original := withBrokerDeadline
+	defer func() { withBrokerDeadline = original }()
+
+	withBrokerDeadline = func(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(parent)
+		cancel() // simulate an already-expired deadline
+		return ctx, cancel
+	}
+
+	r := newTestComponent(time.Second)
+	broker := &fakeBroker{handle: func(ctx context.Context, req *core.DataBrokerReq) (*core.DataBrokerRes, error) {
+		if ctx.Err() == nil {
+			t.Fatal("expected the injected deadline to have already expired")
+		}
+		return nil, errors.New(errors.Operational, ctx.Err())
+	}}
+
+	_, err := r.send(context.Background(), &core.DataBrokerReq{}, dutycycle.State(0), dutycycle.State(0), candidatesOf(broker))
+	if err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+	if got := atomic.LoadInt32(&broker.calls); got != 1 {
+		t.Fatalf("expected the broker to have been called once, got %d", got)
+	}
+}
+
+// TestSend_HedgeFiresOnlyAfterDelay checks that send only fans out beyond
+// hedgeTopN once hedgeDelay has actually elapsed, rather than firing every
+// candidate up front.
+func TestSend_HedgeFiresOnlyAfterDelay(t *testing.T) {
+	r := newTestComponent(time.Second)
+	start := time.Now()
+	var thirdCalledAfter int64 // nanoseconds since start, 0 until called
+
+	block := make(chan struct{})
+	slow := func(ctx context.Context, req *core.DataBrokerReq) (*core.DataBrokerRes, error) {
+		select {
+		case <-block:
+		case <-ctx.Done():
+		}
+		return nil, errors.New(errors.Operational, "slow broker gave up")
+	}
+	third := &fakeBroker{handle: func(ctx context.Context, req *core.DataBrokerReq) (*core.DataBrokerRes, error) {
+		atomic.StoreInt64(&thirdCalledAfter, int64(time.Since(start)))
+		return &core.DataBrokerRes{}, nil
+	}}
+	brokers := []core.BrokerClient{
+		&fakeBroker{handle: slow},
+		&fakeBroker{handle: slow},
+		third,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.send(context.Background(), &core.DataBrokerReq{}, dutycycle.State(0), dutycycle.State(0), candidatesOf(brokers...))
+		close(done)
+	}()
+
+	time.Sleep(hedgeDelay / 2)
+	if atomic.LoadInt64(&thirdCalledAfter) != 0 {
+		t.Fatal("third broker was called before the hedge delay elapsed")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("send did not complete")
+	}
+	close(block)
+
+	elapsed := atomic.LoadInt64(&thirdCalledAfter)
+	if elapsed == 0 {
+		t.Fatal("third broker was never called after the hedge delay")
+	}
+	if time.Duration(elapsed) < hedgeDelay {
+		t.Fatalf("third broker called too early: %v < hedgeDelay %v", time.Duration(elapsed), hedgeDelay)
+	}
+}
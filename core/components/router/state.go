@@ -0,0 +1,82 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"sync"
+	"time"
+)
+
+// brokerSnapshot tracks the runtime health of a single candidate broker,
+// as observed by send, for the admin API's /brokers endpoint.
+type brokerSnapshot struct {
+	lastErr  string
+	inFlight int
+}
+
+// routerState holds the mutable, cross-request bookkeeping the admin API
+// reads from. It is held behind a pointer on component so that the many
+// by-value copies of component floating around the router still share one
+// underlying state. Gateway location/duty metadata is not duplicated here:
+// the admin backend reads that straight from Storage.LookupStats, the same
+// accessor HandleData itself uses, so there is exactly one place that data
+// can drift. This only remembers which gateways have been seen, and when,
+// since Storage has no "list all gateways" accessor of its own.
+type routerState struct {
+	mu       sync.Mutex
+	gateways map[string]time.Time
+	brokers  map[int]brokerSnapshot
+}
+
+func newRouterState() *routerState {
+	return &routerState{
+		gateways: make(map[string]time.Time),
+		brokers:  make(map[int]brokerSnapshot),
+	}
+}
+
+func (s *routerState) seenGateway(id string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gateways[id] = at
+}
+
+func (s *routerState) gatewayLastSeen() map[string]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]time.Time, len(s.gateways))
+	for id, at := range s.gateways {
+		out[id] = at
+	}
+	return out
+}
+
+func (s *routerState) brokerCallStarted(index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := s.brokers[index]
+	snap.inFlight++
+	s.brokers[index] = snap
+}
+
+func (s *routerState) brokerCallFinished(index int, callErr error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := s.brokers[index]
+	snap.inFlight--
+	if callErr != nil {
+		snap.lastErr = callErr.Error()
+	}
+	s.brokers[index] = snap
+}
+
+func (s *routerState) brokerSnapshots() map[int]brokerSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[int]brokerSnapshot, len(s.brokers))
+	for i, snap := range s.brokers {
+		out[i] = snap
+	}
+	return out
+}
@@ -0,0 +1,106 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+// Package telemetry wires the router to OpenTelemetry tracing and metrics.
+// It sits alongside the existing utils/stats meters rather than replacing
+// them: stats.MarkMeter keeps feeding the in-process dashboards operators
+// already rely on, while this package lets the same code paths also emit
+// OTLP spans and instruments once a provider is configured.
+package telemetry
+
+import (
+	"encoding/hex"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	nooplog "go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/trace"
+	nooptrace "go.opentelemetry.io/otel/trace/noop"
+)
+
+// Provider groups the tracer and meter the router instruments itself with.
+type Provider struct {
+	Tracer trace.Tracer
+	Meter  metric.Meter
+}
+
+// Instruments are the OTel counters/histograms recorded by the router. They
+// are created once per Provider so repeated calls don't redeclare them.
+type Instruments struct {
+	UplinkIn       metric.Int64Counter
+	UplinkOut      metric.Int64Counter
+	UplinkDuration metric.Float64Histogram
+	BrokerDuration metric.Float64Histogram
+	BrokerErrors   metric.Int64Counter
+}
+
+// noopProvider is the zero-cost default: every caller of router.New keeps
+// compiling and running exactly as before until SetDefault is called with a
+// real exporter-backed Provider.
+func noopProvider() Provider {
+	return Provider{
+		Tracer: nooptrace.NewTracerProvider().Tracer("ttn/router"),
+		Meter:  nooplog.NewMeterProvider().Meter("ttn/router"),
+	}
+}
+
+// mu guards provider/instruments below: the router reads Default/Instrument
+// from many goroutines on every HandleStats/HandleData/send call, while
+// SetDefault can be called at any time (e.g. hot-reloading exporter config),
+// so plain package vars would race under -race.
+var (
+	mu          sync.RWMutex
+	provider    = noopProvider()
+	instruments = newInstruments(provider)
+)
+
+// Default returns the package-level Provider used by the router unless a
+// specific one is installed via SetDefault. Keeping it package-level -
+// rather than threading it through router.New - lets existing callers of
+// New compile and run unchanged.
+func Default() Provider {
+	mu.RLock()
+	defer mu.RUnlock()
+	return provider
+}
+
+// Instrument returns the Instruments derived from the currently installed
+// Provider.
+func Instrument() Instruments {
+	mu.RLock()
+	defer mu.RUnlock()
+	return instruments
+}
+
+// SetDefault installs p as the Provider used by the router going forward,
+// typically once an OTLP/HTTP or OTLP/gRPC exporter has been configured at
+// startup, and refreshes the derived Instruments.
+func SetDefault(p Provider) {
+	mu.Lock()
+	defer mu.Unlock()
+	provider = p
+	instruments = newInstruments(p)
+}
+
+func newInstruments(p Provider) Instruments {
+	uplinkIn, _ := p.Meter.Int64Counter("router.uplink.in")
+	uplinkOut, _ := p.Meter.Int64Counter("router.uplink.out")
+	uplinkDuration, _ := p.Meter.Float64Histogram("router.uplink.duration")
+	brokerDuration, _ := p.Meter.Float64Histogram("router.broker.call.duration")
+	brokerErrors, _ := p.Meter.Int64Counter("router.broker.errors")
+	return Instruments{
+		UplinkIn:       uplinkIn,
+		UplinkOut:      uplinkOut,
+		UplinkDuration: uplinkDuration,
+		BrokerDuration: brokerDuration,
+		BrokerErrors:   brokerErrors,
+	}
+}
+
+// GatewayID turns a raw gateway identifier into the attribute the router
+// tags its spans and metrics with, hex-encoded to match how the rest of the
+// router logs gateway IDs (hex.EncodeToString(req.GatewayID)).
+func GatewayID(id []byte) attribute.KeyValue {
+	return attribute.String("gateway_id", hex.EncodeToString(id))
+}
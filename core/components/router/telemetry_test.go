@@ -0,0 +1,135 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/KtorZ/rpc/core"
+	"github.com/TheThingsNetwork/ttn/core/components/router/telemetry"
+	"github.com/TheThingsNetwork/ttn/core/dutycycle"
+	"github.com/TheThingsNetwork/ttn/utils/errors"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/net/context"
+)
+
+// withInMemoryTracer installs an in-memory span exporter as the router's
+// telemetry default for the duration of the test, restoring the previous
+// Provider on cleanup, and returns the exporter to inspect recorded spans.
+func withInMemoryTracer(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	original := telemetry.Default()
+	telemetry.SetDefault(telemetry.Provider{Tracer: tp.Tracer("test"), Meter: original.Meter})
+	t.Cleanup(func() { telemetry.SetDefault(original) })
+	return exporter
+}
+
+func spansNamed(spans tracetest.SpanStubs, name string) []tracetest.SpanStub {
+	var out []tracetest.SpanStub
+	for _, s := range spans {
+		if s.Name == name {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func intAttr(attrs []attribute.KeyValue, key string) (int64, bool) {
+	for _, a := range attrs {
+		if string(a.Key) == key {
+			return a.Value.AsInt64(), true
+		}
+	}
+	return 0, false
+}
+
+func TestSend_Broadcast_SpanStructure(t *testing.T) {
+	exporter := withInMemoryTracer(t)
+	r := newTestComponent(time.Second)
+	ok := func(ctx context.Context, req *core.DataBrokerReq) (*core.DataBrokerRes, error) {
+		return &core.DataBrokerRes{}, nil
+	}
+	notFound := func(ctx context.Context, req *core.DataBrokerReq) (*core.DataBrokerRes, error) {
+		return nil, errors.New(errors.NotFound, "no route")
+	}
+	// send only fires the top hedgeTopN brokers up front. The first two find
+	// no route, so send fans out to the third after hedgeDelay and every
+	// broker ends up with a child span.
+	brokers := []core.BrokerClient{
+		&fakeBroker{handle: notFound},
+		&fakeBroker{handle: notFound},
+		&fakeBroker{handle: ok},
+	}
+
+	// A broadcast send passes every known broker as a candidate, same as
+	// HandleData does via r.allCandidates() when no route is on file.
+	if _, err := r.send(context.Background(), &core.DataBrokerReq{}, dutycycle.State(0), dutycycle.State(0), candidatesOf(brokers...)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	spans := exporter.GetSpans()
+	sendSpans := spansNamed(spans, "router.send")
+	if len(sendSpans) != 1 {
+		t.Fatalf("expected exactly one router.send span, got %d", len(sendSpans))
+	}
+	if count, ok := intAttr(sendSpans[0].Attributes, "broker_count"); !ok || count != int64(len(brokers)) {
+		t.Fatalf("expected broker_count %d on the router.send span, got %v (present: %v)", len(brokers), count, ok)
+	}
+
+	brokerSpans := spansNamed(spans, "router.send.broker")
+	if len(brokerSpans) != len(brokers) {
+		t.Fatalf("expected %d router.send.broker child spans for a broadcast, got %d", len(brokers), len(brokerSpans))
+	}
+	seen := map[int64]bool{}
+	for _, s := range brokerSpans {
+		idx, ok := intAttr(s.Attributes, "broker_index")
+		if !ok {
+			t.Fatal("expected a broker_index attribute on every router.send.broker span")
+		}
+		seen[idx] = true
+	}
+	for i := range brokers {
+		if !seen[int64(i)] {
+			t.Fatalf("expected a router.send.broker span for broker_index %d", i)
+		}
+	}
+}
+
+func TestSend_TargetedBroker_SpanStructure(t *testing.T) {
+	exporter := withInMemoryTracer(t)
+	r := newTestComponent(time.Second)
+	ok := func(ctx context.Context, req *core.DataBrokerReq) (*core.DataBrokerRes, error) {
+		return &core.DataBrokerRes{}, nil
+	}
+	// A targeted send only carries the broker(s) a prior route lookup
+	// resolved, same as HandleData's non-broadcast branch.
+	targeted := []brokerCandidate{{index: 2, client: &fakeBroker{handle: ok}}}
+
+	if _, err := r.send(context.Background(), &core.DataBrokerReq{}, dutycycle.State(0), dutycycle.State(0), targeted); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	spans := exporter.GetSpans()
+	sendSpans := spansNamed(spans, "router.send")
+	if len(sendSpans) != 1 {
+		t.Fatalf("expected exactly one router.send span, got %d", len(sendSpans))
+	}
+	if count, ok := intAttr(sendSpans[0].Attributes, "broker_count"); !ok || count != 1 {
+		t.Fatalf("expected broker_count 1 on the router.send span, got %v (present: %v)", count, ok)
+	}
+
+	brokerSpans := spansNamed(spans, "router.send.broker")
+	if len(brokerSpans) != 1 {
+		t.Fatalf("expected exactly one router.send.broker child span for a targeted send, got %d", len(brokerSpans))
+	}
+	if idx, ok := intAttr(brokerSpans[0].Attributes, "broker_index"); !ok || idx != 2 {
+		t.Fatalf("expected broker_index 2 on the targeted send's child span, got %v (present: %v)", idx, ok)
+	}
+}